@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// cacheEntry is what gets stored in the aries response cache. Found is false
+// for a cached negative (not-found) lookup, which is kept under a shorter TTL
+// so it doesn't shadow a record that shows up in Solr shortly after
+type cacheEntry struct {
+	Found   bool        `json:"found"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// Cache is implemented by the pluggable aries response cache backends
+type Cache interface {
+	Get(key string) (cacheEntry, bool)
+	Set(key string, val cacheEntry, ttl time.Duration)
+	Invalidate(key string)
+}
+
+// lruCache is the default in-process cache backend
+type lruCache struct {
+	entries *lru.Cache[string, cacheEntry]
+	timers  map[string]*time.Timer
+	mutex   sync.Mutex
+}
+
+// newLRUCache creates an in-process cache backend holding at most size entries
+func newLRUCache(size int) (*lruCache, error) {
+	entries, err := lru.New[string, cacheEntry](size)
+	if err != nil {
+		return nil, err
+	}
+	return &lruCache{entries: entries, timers: make(map[string]*time.Timer)}, nil
+}
+
+func (c *lruCache) Get(key string) (cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries.Get(key)
+}
+
+// Set stores val under key and (re)arms its expiry timer, stopping any timer
+// left over from a prior Set on the same key so a short-lived negative result
+// can't later expire a fresh positive entry out from under it
+func (c *lruCache) Set(key string, val cacheEntry, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries.Add(key, val)
+	if prior, ok := c.timers[key]; ok {
+		prior.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		// a timer that fired while a newer Set held the lock is stale
+		if c.timers[key] != timer {
+			return
+		}
+		c.entries.Remove(key)
+		delete(c.timers, key)
+	})
+	c.timers[key] = timer
+}
+
+func (c *lruCache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries.Remove(key)
+	if prior, ok := c.timers[key]; ok {
+		prior.Stop()
+		delete(c.timers, key)
+	}
+}
+
+// redisCache is a Redis-backed cache backend, selected with -cachebackend=redis
+type redisCache struct {
+	client *redis.Client
+}
+
+// newRedisCache creates a cache backend that stores entries in the Redis instance at addr
+func newRedisCache(addr string) *redisCache {
+	return &redisCache{client: redis.NewClient(&redis.Options{Addr: addr})}
+}
+
+func (c *redisCache) Get(key string) (cacheEntry, bool) {
+	raw, err := c.client.Get(context.Background(), key).Bytes()
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *redisCache) Set(key string, val cacheEntry, ttl time.Duration) {
+	raw, err := json.Marshal(val)
+	if err != nil {
+		log.Printf("Unable to marshal cache entry for %s: %s", key, err.Error())
+		return
+	}
+	if err := c.client.Set(context.Background(), key, raw, ttl).Err(); err != nil {
+		log.Printf("Unable to cache %s in redis: %s", key, err.Error())
+	}
+}
+
+func (c *redisCache) Invalidate(key string) {
+	if err := c.client.Del(context.Background(), key).Err(); err != nil {
+		log.Printf("Unable to invalidate %s in redis: %s", key, err.Error())
+	}
+}
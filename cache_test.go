@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheSetGetInvalidate(t *testing.T) {
+	c, err := newLRUCache(10)
+	if err != nil {
+		t.Fatalf("newLRUCache: %v", err)
+	}
+
+	c.Set("k1", cacheEntry{Found: true, Payload: "v1"}, time.Minute)
+	if entry, ok := c.Get("k1"); !ok || entry.Payload != "v1" {
+		t.Fatalf("expected cached value v1, got %+v ok=%v", entry, ok)
+	}
+
+	c.Invalidate("k1")
+	if _, ok := c.Get("k1"); ok {
+		t.Fatal("expected cache miss after Invalidate")
+	}
+}
+
+func TestLRUCacheSetReplacesPriorTimer(t *testing.T) {
+	c, err := newLRUCache(10)
+	if err != nil {
+		t.Fatalf("newLRUCache: %v", err)
+	}
+
+	// a short-lived negative entry followed by a longer-lived positive one;
+	// the first timer firing must not evict the second entry
+	c.Set("k", cacheEntry{Found: false}, 5*time.Millisecond)
+	c.Set("k", cacheEntry{Found: true, Payload: "v"}, 50*time.Millisecond)
+
+	time.Sleep(15 * time.Millisecond)
+	entry, ok := c.Get("k")
+	if !ok || !entry.Found {
+		t.Fatalf("expected the longer-TTL positive entry to survive the shorter timer, got ok=%v entry=%+v", ok, entry)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -9,10 +10,17 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/uvalib/aries-virgo/serviceMappers"
 )
 
 // Version of the service
@@ -23,6 +31,34 @@ var solrURL string
 var solrCore string
 var virgoURL string
 
+// maxConcurrency caps the number of Solr lookups a batch request runs in parallel
+var maxConcurrency int
+
+// solrTimeout bounds how long a single Solr request is allowed to run
+var solrTimeout time.Duration
+
+// solrClient is a shared HTTP client reused across all Solr calls so
+// connections are pooled instead of re-dialed on every request
+var solrClient = &http.Client{}
+
+// shuttingDown flips to 1 as soon as shutdown begins so /readiness can
+// start failing before the server finishes draining in-flight requests
+var shuttingDown int32
+
+// cacheTTL is how long a resolved aries response stays in the cache
+var cacheTTL time.Duration
+
+// negativeCacheTTL is how long a not-found result stays in the cache; kept
+// short so a record that shows up in Solr isn't shadowed for long
+var negativeCacheTTL time.Duration
+
+// cacheSize bounds the number of entries held by the in-process LRU backend
+var cacheSize int
+
+// responseCache is the pluggable cache fronting ariesLookup, selected at
+// startup via -cachebackend
+var responseCache Cache
+
 // aries is the structure of the response returned by /api/aries/:id
 type aries struct {
 	Identifiers []string     `json:"identifier,omitempty"`
@@ -36,6 +72,12 @@ type serviceURL struct {
 	Protocol string `json:"protocol,omitempty"`
 }
 
+// ariesMatches wraps the aries entries for an identifier that legitimately
+// maps to more than one catalog record
+type ariesMatches struct {
+	Matches []aries `json:"matches"`
+}
+
 // solrFullResponse is the complete structure of a solr response. It is
 // made up of two parts; a header and the response data
 type solrFullResponse struct {
@@ -58,12 +100,15 @@ type solrResponse struct {
 
 // solrDoc is the full response data returned by a solr query
 type solrDoc struct {
-	ID                    string   `json:"id"`
-	ShadowedLocationFacet []string `json:"shadowed_location_facet"`
-	MarcDisplay           string   `json:"marc_display"`
-	AlternateIDFacet      []string `json:"alternate_id_facet"`
-	BarcodeFacet          []string `json:"barcode_facet"`
-	FeatureFacet          []string `json:"feature_facet"`
+	ID                      string   `json:"id"`
+	ShadowedLocationFacet   []string `json:"shadowed_location_facet"`
+	MarcDisplay             string   `json:"marc_display"`
+	AlternateIDFacet        []string `json:"alternate_id_facet"`
+	BarcodeFacet            []string `json:"barcode_facet"`
+	FeatureFacet            []string `json:"feature_facet"`
+	FormatFacet             []string `json:"format_facet"`
+	IIIFPresentationVersion []string `json:"iiif_presentation_version"`
+	PDFURLDisplay           string   `json:"pdf_url_display"`
 }
 
 // favHandler is a dummy handler to silence browser API requests that look for /favicon.ico
@@ -81,7 +126,7 @@ func healthCheckHandler(c *gin.Context) {
 	hcMap["AriesVirgo"] = "true"
 	// ping the api with a minimal request to see if it is alive
 	url := fmt.Sprintf("%s/%s/select?q=*:*&wt=json&rows=0", solrURL, solrCore)
-	_, err := getAPIResponse(url)
+	_, err := getAPIResponse(c.Request.Context(), url)
 	if err != nil {
 		hcMap["Virgo"] = "false"
 	} else {
@@ -90,26 +135,103 @@ func healthCheckHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, hcMap)
 }
 
-/// ariesPing handles requests to the aries endpoint with no params.
-// Just returns and alive message
+// readinessHandler reports whether the service should keep receiving traffic.
+// It flips to non-200 as soon as shutdown begins so load balancers stop
+// routing new requests while in-flight ones drain
+func readinessHandler(c *gin.Context) {
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		c.String(http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	c.String(http.StatusOK, "ready")
+}
+
+/// ariesPing handles requests to the aries endpoint with no params. If an
+// ids query param is present, it is treated as a batch lookup; otherwise
+// it just returns an alive message
 func ariesPing(c *gin.Context) {
+	if c.Query("ids") != "" {
+		bulkAriesLookup(c)
+		return
+	}
 	c.String(http.StatusOK, "Virgo Aries API")
 }
 
-// ariesLookup will query APTrust for information on the supplied identifer
+// ariesLookupError carries the HTTP status that should be reported for a
+// failed identifier lookup along with a human readable message
+type ariesLookupError struct {
+	Status  int
+	Message string
+}
+
+func (e *ariesLookupError) Error() string {
+	return e.Message
+}
+
+// ariesLookup will query the Virgo Solr index for information on the supplied identifer.
+// A multi=true query param allows a barcode or alternate ID that legitimately
+// maps to more than one catalog record to be returned as an ariesMatches list
+// instead of the default 400. Results are served from responseCache when possible
 func ariesLookup(c *gin.Context) {
 	passedID := c.Param("id")
+	allowMulti := c.Query("multi") == "true"
+	cacheKey := ariesCacheKey(passedID, allowMulti)
+
+	if entry, ok := responseCache.Get(cacheKey); ok {
+		cacheHits.Inc()
+		if !entry.Found {
+			c.String(http.StatusNotFound, "%s not found", passedID)
+			return
+		}
+		c.JSON(http.StatusOK, entry.Payload)
+		return
+	}
+	cacheMisses.Inc()
+
+	out, err := resolveAries(c.Request.Context(), passedID, allowMulti)
+	if err != nil {
+		lookupErr, _ := err.(*ariesLookupError)
+		if lookupErr.Status == http.StatusNotFound {
+			responseCache.Set(cacheKey, cacheEntry{Found: false}, negativeCacheTTL)
+		}
+		c.String(lookupErr.Status, lookupErr.Message)
+		return
+	}
+	responseCache.Set(cacheKey, cacheEntry{Found: true, Payload: out}, cacheTTL)
+	c.JSON(http.StatusOK, out)
+}
+
+// ariesInvalidate removes any cached entry for the supplied identifier, under
+// both the multi and non-multi cache keys
+func ariesInvalidate(c *gin.Context) {
+	passedID := c.Param("id")
+	responseCache.Invalidate(ariesCacheKey(passedID, false))
+	responseCache.Invalidate(ariesCacheKey(passedID, true))
+	c.Status(http.StatusNoContent)
+}
+
+// ariesCacheKey builds the cache key for an identifier lookup. allowMulti is
+// folded in so a ?multi=true response can never be served back to a plain
+// lookup (or vice versa) via the cache
+func ariesCacheKey(id string, allowMulti bool) string {
+	return strings.ToLower(strings.TrimSpace(id)) + ":" + strconv.FormatBool(allowMulti)
+}
+
+// resolveAries runs the Solr lookup for a single identifier and assembles the
+// aries response. It is shared by the single-identifier and batch handlers.
+// When allowMulti is false (the historical behavior), more than one Solr hit
+// is reported as a 400; when true, all hits are returned as an ariesMatches
+func resolveAries(ctx context.Context, passedID string, allowMulti bool) (interface{}, error) {
 	var qps []string
 	qps = append(qps, url.QueryEscape(fmt.Sprintf("id:\"%s\"", passedID)))
 	qps = append(qps, url.QueryEscape(fmt.Sprintf("alternate_id_facet:\"%s\"", passedID)))
 	qps = append(qps, url.QueryEscape(fmt.Sprintf("barcode_facet:\"%s\"", passedID)))
-	fl := "&fl=id,shadowed_location_facet,marc_display,alternate_id_facet,barcode_facet,feature_facet"
+	fl := "&fl=id,shadowed_location_facet,marc_display,alternate_id_facet,barcode_facet,feature_facet,format_facet,iiif_presentation_version,pdf_url_display"
 	urlStr := fmt.Sprintf("%s/%s/select?q=%s&wt=json&indent=true%s", solrURL, solrCore, strings.Join(qps, "+"), fl)
-	respStr, err := getAPIResponse(urlStr)
+	respStr, err := getAPIResponse(ctx, urlStr)
 	if err != nil {
 		log.Printf("Query for %s FAILED: %s", passedID, err.Error())
-		c.String(http.StatusNotFound, err.Error())
-		return
+		return nil, &ariesLookupError{http.StatusNotFound, err.Error()}
 	}
 
 	log.Printf("Parsing solr response for #{passedID}")
@@ -117,30 +239,39 @@ func ariesLookup(c *gin.Context) {
 	marshallErr := json.Unmarshal([]byte(respStr), &resp)
 	if marshallErr != nil {
 		log.Printf("Unable to parse response: %s", marshallErr.Error())
-		c.String(http.StatusNotFound, "%s not found", passedID)
-		return
+		return nil, &ariesLookupError{http.StatusNotFound, fmt.Sprintf("%s not found", passedID)}
 	}
 
 	if resp.ResponseHeader.Status != 0 {
 		log.Printf("Failed response for %s: %d", passedID, resp.ResponseHeader.Status)
-		c.String(http.StatusNotFound, "%s not found", passedID)
-		return
+		return nil, &ariesLookupError{http.StatusNotFound, fmt.Sprintf("%s not found", passedID)}
 	}
 
 	if resp.Response.NumFound == 0 {
 		log.Printf("Query for %s had no hits", passedID)
-		c.String(http.StatusNotFound, "%s not found", passedID)
-		return
+		return nil, &ariesLookupError{http.StatusNotFound, fmt.Sprintf("%s not found", passedID)}
 	}
 
 	if resp.Response.NumFound > 1 {
-		log.Printf("Query for %s had too many hits", passedID)
-		c.String(http.StatusBadRequest, "%s has too many hits. Query: %s", passedID, urlStr)
-		return
+		if !allowMulti {
+			log.Printf("Query for %s had too many hits", passedID)
+			return nil, &ariesLookupError{http.StatusBadRequest, fmt.Sprintf("%s has too many hits. Query: %s", passedID, urlStr)}
+		}
+		log.Printf("Query for %s had %d hits; returning as matches", passedID, resp.Response.NumFound)
+		var matches ariesMatches
+		for _, doc := range resp.Response.Docs {
+			matches.Matches = append(matches.Matches, buildAries(doc))
+		}
+		return &matches, nil
 	}
 
+	out := buildAries(resp.Response.Docs[0])
+	return &out, nil
+}
+
+// buildAries assembles the aries response fields for a single Solr document
+func buildAries(doc solrDoc) aries {
 	var out aries
-	doc := resp.Response.Docs[0]
 	out.Identifiers = append(out.Identifiers, doc.ID)
 	for _, altID := range doc.AlternateIDFacet {
 		out.Identifiers = append(out.Identifiers, altID)
@@ -153,11 +284,8 @@ func ariesLookup(c *gin.Context) {
 		URL:      fmt.Sprintf("%s/%s/select?q=%s", solrURL, solrCore, qp),
 		Protocol: "virgo-index"}
 	out.ServiceURL = append(out.ServiceURL, svcURL)
-	if hasValue(doc.FeatureFacet, "iiif") {
-		svcURL := serviceURL{
-			URL:      fmt.Sprintf("%s/catalog/%s/iiif/manifest.json", virgoURL, doc.ID),
-			Protocol: "iiif-presentation"}
-		out.ServiceURL = append(out.ServiceURL, svcURL)
+	for _, mapped := range serviceMappers.Resolve(toMapperDoc(doc), virgoURL) {
+		out.ServiceURL = append(out.ServiceURL, serviceURL{URL: mapped.URL, Protocol: mapped.Protocol})
 	}
 
 	if doc.ShadowedLocationFacet == nil || hasValue(doc.ShadowedLocationFacet, "VISIBLE") {
@@ -168,7 +296,141 @@ func ariesLookup(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusOK, out)
+	return out
+}
+
+// toMapperDoc adapts a solrDoc to the shape serviceMappers.Resolve expects
+func toMapperDoc(doc solrDoc) serviceMappers.SolrDoc {
+	mapperDoc := serviceMappers.SolrDoc{
+		ID:            doc.ID,
+		FeatureFacet:  doc.FeatureFacet,
+		FormatFacet:   doc.FormatFacet,
+		PDFURLDisplay: doc.PDFURLDisplay,
+	}
+	if len(doc.IIIFPresentationVersion) > 0 {
+		mapperDoc.IIIFPresentationVersion = doc.IIIFPresentationVersion[0]
+	}
+	return mapperDoc
+}
+
+// bulkRequest is the POST body accepted by the batch lookup endpoint
+type bulkRequest struct {
+	Identifiers []string `json:"identifiers"`
+}
+
+// bulkError is the error shape returned for an identifier that failed to resolve
+type bulkError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// bulkSummary totals the outcomes of a batch lookup
+type bulkSummary struct {
+	Total    int `json:"total"`
+	Found    int `json:"found"`
+	NotFound int `json:"not_found"`
+	Errors   int `json:"errors"`
+}
+
+// bulkResponse is the aggregate response returned by the batch lookup endpoint
+type bulkResponse struct {
+	Results map[string]json.RawMessage `json:"results"`
+	Summary bulkSummary                `json:"summary"`
+}
+
+// bulkAriesLookup resolves many identifiers in one call, fanning the Solr
+// queries out across a bounded pool of goroutines so a single slow or bad ID
+// does not stall the rest of the batch. Duplicate identifiers collapse to a
+// single Solr query
+func bulkAriesLookup(c *gin.Context) {
+	ids := parseBulkIDs(c)
+	if len(ids) == 0 {
+		c.String(http.StatusBadRequest, "no identifiers supplied")
+		return
+	}
+
+	unique := dedupeIDs(ids)
+	resolved := make(map[string]interface{})
+	failed := make(map[string]*bulkError)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrency)
+	ctx := c.Request.Context()
+
+	for _, id := range unique {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// batch lookups keep the historical single-hit contract
+			out, err := resolveAries(ctx, id, false)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				lookupErr, _ := err.(*ariesLookupError)
+				failed[id] = &bulkError{Code: lookupErr.Status, Message: lookupErr.Message}
+				return
+			}
+			resolved[id] = out
+		}(id)
+	}
+	wg.Wait()
+
+	results := make(map[string]json.RawMessage, len(unique))
+	summary := bulkSummary{Total: len(unique)}
+	for _, id := range unique {
+		if out, ok := resolved[id]; ok {
+			summary.Found++
+			raw, _ := json.Marshal(out)
+			results[id] = raw
+			continue
+		}
+		bulkErr := failed[id]
+		if bulkErr.Code == http.StatusNotFound {
+			summary.NotFound++
+		} else {
+			summary.Errors++
+		}
+		raw, _ := json.Marshal(gin.H{"error": bulkErr})
+		results[id] = raw
+	}
+
+	c.JSON(http.StatusOK, bulkResponse{Results: results, Summary: summary})
+}
+
+// parseBulkIDs reads the identifier list from a POST JSON body
+// ({"identifiers": [...]}) or, for GET requests, a comma-separated
+// ids query param
+func parseBulkIDs(c *gin.Context) []string {
+	if c.Request.Method == http.MethodPost {
+		var req bulkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return nil
+		}
+		return req.Identifiers
+	}
+	idsParam := c.Query("ids")
+	if idsParam == "" {
+		return nil
+	}
+	return strings.Split(idsParam, ",")
+}
+
+// dedupeIDs trims whitespace and collapses duplicate identifiers, preserving
+// the order they were first seen in
+func dedupeIDs(ids []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	return out
 }
 
 func hasValue(values []string, tgtVal string) bool {
@@ -180,14 +442,19 @@ func hasValue(values []string, tgtVal string) bool {
 	return false
 }
 
-// getAPIResponse is a helper used to call a JSON endpoint and return the resoponse as a string
-func getAPIResponse(url string) (string, error) {
+// getAPIResponse is a helper used to call a JSON endpoint and return the resoponse as a string.
+// The request is bound to ctx and also given its own solrTimeout deadline, so a client
+// disconnect or a slow Solr both abort the in-flight request promptly
+func getAPIResponse(ctx context.Context, url string) (string, error) {
 	log.Printf("Get resonse for: %s", url)
-	timeout := time.Duration(10 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+	reqCtx, cancel := context.WithTimeout(ctx, solrTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
 	}
-	resp, err := client.Get(url)
+	resp, err := solrClient.Do(req)
 	if err != nil {
 		log.Printf("Unable to GET %s: %s", url, err.Error())
 		return "", err
@@ -215,7 +482,33 @@ func main() {
 	flag.StringVar(&solrURL, "solrurl", "http://solr.lib.virginia.edu:8082/solr", "Solr base URL")
 	flag.StringVar(&solrCore, "solrcore", "core", "Solr core")
 	flag.StringVar(&virgoURL, "virgourl", "https://search.lib.virginia.edu", "Virgo URL")
+	flag.IntVar(&maxConcurrency, "maxconcurrency", 8, "Maximum concurrent Solr lookups for a batch request")
+	flag.DurationVar(&solrTimeout, "solrtimeout", 10*time.Second, "Timeout for a single Solr request")
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", 30*time.Second, "Grace period to drain in-flight requests on shutdown")
+	flag.DurationVar(&cacheTTL, "cachettl", 5*time.Minute, "TTL for a cached aries response")
+	flag.IntVar(&cacheSize, "cachesize", 1024, "Maximum entries held by the in-process cache backend")
+	var cacheBackend string
+	flag.StringVar(&cacheBackend, "cachebackend", "lru", "Response cache backend: lru or redis")
+	var redisAddr string
+	flag.StringVar(&redisAddr, "redisaddr", "localhost:6379", "Redis address, used when -cachebackend=redis")
 	flag.Parse()
+	if maxConcurrency <= 0 {
+		log.Fatalf("-maxconcurrency must be greater than 0, got %d", maxConcurrency)
+	}
+	negativeCacheTTL = cacheTTL / 5
+
+	log.Printf("Setup cache backend %s...", cacheBackend)
+	switch cacheBackend {
+	case "redis":
+		responseCache = newRedisCache(redisAddr)
+	default:
+		lruBackend, err := newLRUCache(cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		responseCache = lruBackend
+	}
 
 	log.Printf("Setup routes...")
 	gin.SetMode(gin.ReleaseMode)
@@ -224,13 +517,41 @@ func main() {
 	router.GET("/favicon.ico", favHandler)
 	router.GET("/version", versionHandler)
 	router.GET("/healthcheck", healthCheckHandler)
+	router.GET("/readiness", readinessHandler)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	api := router.Group("/api")
 	{
 		api.GET("/aries", ariesPing)
+		api.POST("/aries", bulkAriesLookup)
 		api.GET("/aries/:id", ariesLookup)
+		api.DELETE("/aries/:id", ariesInvalidate)
 	}
 
 	portStr := fmt.Sprintf(":%d", port)
-	log.Printf("Start Aries Virgo v%s on port %s", version, portStr)
-	log.Fatal(router.Run(portStr))
+	server := &http.Server{
+		Addr:    portStr,
+		Handler: router,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Start Aries Virgo v%s on port %s", version, portStr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	atomic.StoreInt32(&shuttingDown, 1)
+	log.Printf("Shutdown signal received; draining in-flight requests (grace period %s)...", shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown failed: %s", err.Error())
+	}
+	log.Printf("===> Aries Virgo service shut down <===")
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestDedupeIDs(t *testing.T) {
+	in := []string{"a", " b ", "a", "", "c", "b"}
+	want := []string{"a", "b", "c"}
+	if got := dedupeIDs(in); !reflect.DeepEqual(got, want) {
+		t.Fatalf("dedupeIDs(%v) = %v, want %v", in, got, want)
+	}
+}
+
+func TestAriesCacheKeyDistinguishesMulti(t *testing.T) {
+	if ariesCacheKey("X", false) == ariesCacheKey("X", true) {
+		t.Fatal("expected distinct cache keys for multi vs non-multi lookups")
+	}
+}
+
+// TestAriesInvalidateClearsBothKeys guards against the regression where
+// ariesInvalidate cleared a key that resolveAries/ariesLookup never wrote to
+func TestAriesInvalidateClearsBothKeys(t *testing.T) {
+	origCache := responseCache
+	cache, err := newLRUCache(10)
+	if err != nil {
+		t.Fatalf("newLRUCache: %v", err)
+	}
+	responseCache = cache
+	defer func() { responseCache = origCache }()
+
+	responseCache.Set(ariesCacheKey("X", false), cacheEntry{Found: true}, time.Minute)
+	responseCache.Set(ariesCacheKey("X", true), cacheEntry{Found: true}, time.Minute)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "id", Value: "X"}}
+
+	ariesInvalidate(c)
+
+	if _, ok := responseCache.Get(ariesCacheKey("X", false)); ok {
+		t.Fatal("expected the non-multi cache entry to be invalidated")
+	}
+	if _, ok := responseCache.Get(ariesCacheKey("X", true)); ok {
+		t.Fatal("expected the multi cache entry to be invalidated")
+	}
+}
+
+// fakeSolrBackend serves canned solrFullResponse documents keyed by id, and
+// can simulate an upstream failure for a given id
+type fakeSolrBackend struct {
+	docs   map[string][]solrDoc
+	failOn map[string]bool
+}
+
+var idPattern = regexp.MustCompile(`id:"([^"]*)"`)
+
+func newFakeSolrServer(t *testing.T, backend fakeSolrBackend) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := idPattern.FindStringSubmatch(r.URL.Query().Get("q"))
+		id := ""
+		if len(m) == 2 {
+			id = m[1]
+		}
+		if backend.failOn[id] {
+			http.Error(w, "solr exploded", http.StatusInternalServerError)
+			return
+		}
+		docs := backend.docs[id]
+		resp := solrFullResponse{Response: solrResponse{NumFound: len(docs), Docs: docs}}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Fatalf("unable to encode fake solr response: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// withFakeSolr points the package-level Solr config at a fake server for the
+// duration of fn, restoring the previous values afterward
+func withFakeSolr(t *testing.T, backend fakeSolrBackend, fn func()) {
+	srv := newFakeSolrServer(t, backend)
+	origURL, origCore, origTimeout := solrURL, solrCore, solrTimeout
+	solrURL, solrCore, solrTimeout = srv.URL, "core", 2*time.Second
+	defer func() { solrURL, solrCore, solrTimeout = origURL, origCore, origTimeout }()
+	fn()
+}
+
+func TestResolveAriesMultiFlag(t *testing.T) {
+	withFakeSolr(t, fakeSolrBackend{docs: map[string][]solrDoc{
+		"dup": {{ID: "rec1"}, {ID: "rec2"}},
+	}}, func() {
+		if _, err := resolveAries(context.Background(), "dup", false); err == nil {
+			t.Fatal("expected an error for a multi-hit lookup with allowMulti=false")
+		} else if lookupErr, ok := err.(*ariesLookupError); !ok || lookupErr.Status != http.StatusBadRequest {
+			t.Fatalf("expected a 400 ariesLookupError, got %v", err)
+		}
+
+		out, err := resolveAries(context.Background(), "dup", true)
+		if err != nil {
+			t.Fatalf("unexpected error with allowMulti=true: %v", err)
+		}
+		matches, ok := out.(*ariesMatches)
+		if !ok || len(matches.Matches) != 2 {
+			t.Fatalf("expected 2 matches, got %+v", out)
+		}
+	})
+}
+
+func TestBulkAriesLookupDedupAndPartialFailure(t *testing.T) {
+	origConcurrency := maxConcurrency
+	maxConcurrency = 4
+	defer func() { maxConcurrency = origConcurrency }()
+
+	withFakeSolr(t, fakeSolrBackend{
+		docs: map[string][]solrDoc{
+			"ok1":  {{ID: "ok1"}},
+			"ok2":  {{ID: "ok2"}},
+			"dup1": {{ID: "dup1a"}, {ID: "dup1b"}},
+		},
+		failOn: map[string]bool{"bad1": true},
+	}, func() {
+		body := `{"identifiers": ["ok1", "ok1", "ok2", "bad1", "dup1", "missing1"]}`
+		req := httptest.NewRequest(http.MethodPost, "/api/aries", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+
+		bulkAriesLookup(c)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp bulkResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unable to decode batch response: %v", err)
+		}
+
+		// ok1 appears twice in the request and must collapse to one Solr query
+		if resp.Summary.Total != 5 {
+			t.Fatalf("expected 5 unique identifiers after dedup, got %d", resp.Summary.Total)
+		}
+		if resp.Summary.Found != 2 {
+			t.Fatalf("expected 2 found (ok1, ok2), got %d", resp.Summary.Found)
+		}
+		if resp.Summary.NotFound != 2 {
+			t.Fatalf("expected 2 not_found (bad1, missing1), got %d", resp.Summary.NotFound)
+		}
+		if resp.Summary.Errors != 1 {
+			t.Fatalf("expected 1 error (dup1's too-many-hits), got %d", resp.Summary.Errors)
+		}
+		if _, ok := resp.Results["ok1"]; !ok {
+			t.Fatal("expected a result entry for ok1")
+		}
+	})
+}
@@ -0,0 +1,19 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// cacheHits and cacheMisses track how effectively the response cache is
+// protecting Solr from repeated lookups, surfaced on /metrics
+var cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "aries_virgo_cache_hits_total",
+	Help: "Number of aries lookups served from cache",
+})
+
+var cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "aries_virgo_cache_misses_total",
+	Help: "Number of aries lookups that missed the cache",
+})
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses)
+}
@@ -0,0 +1,114 @@
+// Package serviceMappers provides a table-driven mapping from Solr document
+// facets to the service_url entries an aries response should expose for the
+// Virgo delivery protocols a record supports (IIIF, OAI-PMH, PDF download,
+// streaming, ...). New delivery channels are added by registering another
+// Mapper rather than editing the aries handler directly.
+package serviceMappers
+
+import "fmt"
+
+// SolrDoc is the subset of Solr document fields a mapper needs in order to
+// decide which delivery protocols a record supports
+type SolrDoc struct {
+	ID                      string
+	FeatureFacet            []string
+	FormatFacet             []string
+	IIIFPresentationVersion string
+	PDFURLDisplay           string
+}
+
+// ServiceURL is a single delivery protocol entry for an aries response
+type ServiceURL struct {
+	URL      string
+	Protocol string
+}
+
+// Mapper inspects a SolrDoc and returns zero or more ServiceURL entries for
+// the delivery protocols it recognizes
+type Mapper func(doc SolrDoc, virgoURL string) []ServiceURL
+
+// Mappers is the set of mappers applied to every Solr document, in order
+var Mappers = []Mapper{
+	iiifPresentationMapper,
+	oaiPMHMapper,
+	pdfDownloadMapper,
+	streamingMapper,
+}
+
+// Resolve runs every registered mapper against doc and returns the union of
+// their results
+func Resolve(doc SolrDoc, virgoURL string) []ServiceURL {
+	var out []ServiceURL
+	for _, mapper := range Mappers {
+		out = append(out, mapper(doc, virgoURL)...)
+	}
+	return out
+}
+
+func hasValue(values []string, tgtVal string) bool {
+	for _, val := range values {
+		if val == tgtVal {
+			return true
+		}
+	}
+	return false
+}
+
+// iiifPresentationMapper emits an IIIF manifest URL, distinguishing
+// presentation API v2 from v3 via the iiif_presentation_version facet
+func iiifPresentationMapper(doc SolrDoc, virgoURL string) []ServiceURL {
+	if !hasValue(doc.FeatureFacet, "iiif") {
+		return nil
+	}
+	protocol := "iiif-presentation"
+	switch doc.IIIFPresentationVersion {
+	case "2":
+		protocol = "iiif-presentation-v2"
+	case "3":
+		protocol = "iiif-presentation-v3"
+	}
+	return []ServiceURL{{
+		URL:      fmt.Sprintf("%s/catalog/%s/iiif/manifest.json", virgoURL, doc.ID),
+		Protocol: protocol,
+	}}
+}
+
+// oaiPMHMapper emits an OAI-PMH record URL for harvestable records
+func oaiPMHMapper(doc SolrDoc, virgoURL string) []ServiceURL {
+	if !hasValue(doc.FeatureFacet, "oai_harvestable") {
+		return nil
+	}
+	return []ServiceURL{{
+		URL:      fmt.Sprintf("%s/oai?verb=GetRecord&identifier=%s&metadataPrefix=oai_dc", virgoURL, doc.ID),
+		Protocol: "oai-pmh",
+	}}
+}
+
+// pdfDownloadMapper emits a direct PDF download URL when the record has one
+func pdfDownloadMapper(doc SolrDoc, virgoURL string) []ServiceURL {
+	if doc.PDFURLDisplay == "" {
+		return nil
+	}
+	return []ServiceURL{{
+		URL:      doc.PDFURLDisplay,
+		Protocol: "pdf-download",
+	}}
+}
+
+// streamingMapper emits a streaming URL for audio/video delivery formats
+func streamingMapper(doc SolrDoc, virgoURL string) []ServiceURL {
+	var out []ServiceURL
+	if hasValue(doc.FormatFacet, "Video") {
+		out = append(out, ServiceURL{
+			URL:      fmt.Sprintf("%s/catalog/%s/stream", virgoURL, doc.ID),
+			Protocol: "streaming-video",
+		})
+	}
+	if hasValue(doc.FormatFacet, "Audio") {
+		out = append(out, ServiceURL{
+			URL:      fmt.Sprintf("%s/catalog/%s/stream", virgoURL, doc.ID),
+			Protocol: "streaming-audio",
+		})
+	}
+	return out
+}
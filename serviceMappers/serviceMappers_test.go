@@ -0,0 +1,94 @@
+package serviceMappers
+
+import "testing"
+
+const testVirgoURL = "https://search.lib.virginia.edu"
+
+func protocols(entries []ServiceURL) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Protocol)
+	}
+	return out
+}
+
+func contains(protocols []string, tgt string) bool {
+	for _, p := range protocols {
+		if p == tgt {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIIIFPresentationMapper(t *testing.T) {
+	doc := SolrDoc{ID: "u1", FeatureFacet: []string{"iiif"}, IIIFPresentationVersion: "3"}
+	got := iiifPresentationMapper(doc, testVirgoURL)
+	if len(got) != 1 || got[0].Protocol != "iiif-presentation-v3" {
+		t.Fatalf("expected a single iiif-presentation-v3 entry, got %+v", got)
+	}
+	if got[0].URL != testVirgoURL+"/catalog/u1/iiif/manifest.json" {
+		t.Fatalf("unexpected manifest URL: %s", got[0].URL)
+	}
+}
+
+func TestIIIFPresentationMapperDefaultsWithoutVersion(t *testing.T) {
+	doc := SolrDoc{ID: "u2", FeatureFacet: []string{"iiif"}}
+	got := iiifPresentationMapper(doc, testVirgoURL)
+	if len(got) != 1 || got[0].Protocol != "iiif-presentation" {
+		t.Fatalf("expected the default iiif-presentation protocol, got %+v", got)
+	}
+}
+
+func TestIIIFPresentationMapperSkipsNonIIIF(t *testing.T) {
+	doc := SolrDoc{ID: "u3", FeatureFacet: []string{"something_else"}}
+	if got := iiifPresentationMapper(doc, testVirgoURL); got != nil {
+		t.Fatalf("expected no entries, got %+v", got)
+	}
+}
+
+func TestOAIPMHMapper(t *testing.T) {
+	doc := SolrDoc{ID: "u4", FeatureFacet: []string{"oai_harvestable"}}
+	got := oaiPMHMapper(doc, testVirgoURL)
+	if len(got) != 1 || got[0].Protocol != "oai-pmh" {
+		t.Fatalf("expected a single oai-pmh entry, got %+v", got)
+	}
+}
+
+func TestPDFDownloadMapper(t *testing.T) {
+	doc := SolrDoc{ID: "u5", PDFURLDisplay: "https://example.org/u5.pdf"}
+	got := pdfDownloadMapper(doc, testVirgoURL)
+	if len(got) != 1 || got[0].Protocol != "pdf-download" || got[0].URL != doc.PDFURLDisplay {
+		t.Fatalf("expected a single pdf-download entry pointing at the display URL, got %+v", got)
+	}
+}
+
+func TestPDFDownloadMapperSkipsWhenAbsent(t *testing.T) {
+	doc := SolrDoc{ID: "u6"}
+	if got := pdfDownloadMapper(doc, testVirgoURL); got != nil {
+		t.Fatalf("expected no entries, got %+v", got)
+	}
+}
+
+func TestStreamingMapper(t *testing.T) {
+	doc := SolrDoc{ID: "u7", FormatFacet: []string{"Video", "Audio"}}
+	got := streamingMapper(doc, testVirgoURL)
+	ps := protocols(got)
+	if !contains(ps, "streaming-video") || !contains(ps, "streaming-audio") {
+		t.Fatalf("expected both streaming protocols, got %+v", ps)
+	}
+}
+
+func TestResolveUnionsAllMappers(t *testing.T) {
+	doc := SolrDoc{
+		ID:           "u8",
+		FeatureFacet: []string{"iiif", "oai_harvestable"},
+		FormatFacet:  []string{"Video"},
+	}
+	ps := protocols(Resolve(doc, testVirgoURL))
+	for _, want := range []string{"iiif-presentation", "oai-pmh", "streaming-video"} {
+		if !contains(ps, want) {
+			t.Fatalf("expected %s among %+v", want, ps)
+		}
+	}
+}